@@ -25,6 +25,7 @@ var (
 	urlTarget   = flag.String("u", "", "url to download")
 	outFileName = flag.String("o", "", "name of output file")
 	toStdout    = flag.Bool("s", false, "output to stdout")
+	selfTest    = flag.Bool("selftest", false, "run built-in transfer tests and exit")
 )
 
 // general settings
@@ -39,45 +40,87 @@ var progressBar = "-----------------------------------"
 func main() {
 
 	flag.Parse()
+	if *selfTest {
+		if err := runSelfTest(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *urlTarget == "" {
 		usage()
 	}
 	url := normalizeURLTarget(*urlTarget)
 
-	// start http client
-	client := &http.Client{}
-	resp, err := client.Get(url)
-	if err != nil {
+	// run closes and cleans up everything itself so we only exit here
+	if err := run(&http.Client{}, url, *outFileName, *toStdout, os.Stdout); err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
+}
 
-	// open output file; nil if stdout was requested
-	file := os.Stdout
-	if !*toStdout {
-		file, err = openOutfile(*outFileName, url)
-		if err != nil {
-			log.Fatal("failed to open output file: ", err)
-		}
-		defer file.Close()
-		printInfo(url, resp)
+// run retrieves url via client and writes the content either to stdout
+// or the requested output file. Connection info and progress for file
+// downloads are written to status. Any partially written output file is
+// removed if the transfer fails.
+func run(client *http.Client, url, outFileName string, wantStdout bool,
+	status io.Writer) error {
+
+	resp, err := get(client, url)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
 	totalBytes := resp.ContentLength
-	bytesRead, err := copyContent(resp.Body, file, totalBytes, *toStdout)
+	if wantStdout {
+		_, err = copyContent(resp.Body, os.Stdout, totalBytes, nil)
+		return err
+	}
+
+	file, err := openOutfile(outFileName, url)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to open output file: %v", err)
 	}
+	printInfo(status, url, resp)
 
-	if !*toStdout {
-		fmt.Println(statusString(bytesRead, totalBytes, true))
+	bytesRead, err := copyContent(resp.Body, file, totalBytes, status)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		fmt.Fprintln(status)
+		if removeErr := os.Remove(file.Name()); removeErr != nil {
+			return fmt.Errorf("%v (failed to remove partial file %s: %v)", err,
+				file.Name(), removeErr)
+		}
+		return err
+	}
+
+	fmt.Fprintln(status, statusString(bytesRead, totalBytes, true))
+	return nil
+}
+
+// get issues a GET request for url and returns the response if the
+// server answered with a success status and the full content. The caller
+// has to close the response body.
+func get(client *http.Client, url string) (*http.Response, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	// we never send Range requests so partial content is an error too
+	if resp.StatusCode < 200 || resp.StatusCode > 299 ||
+		resp.StatusCode == http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resp, nil
 }
 
 // copyContent reads the body content from the http connection and then
-// copies it either to the provided file or stdou
-func copyContent(body io.ReadCloser, file *os.File, totalBytes int64,
-	wantStdout bool) (int, error) {
+// copies it either to the provided file or stdout. Progress is written to
+// status unless it is nil.
+func copyContent(body io.Reader, file io.Writer, totalBytes int64,
+	status io.Writer) (int, error) {
 
 	buffer := make([]byte, numBytes)
 	bytesRead := 0
@@ -90,41 +133,43 @@ func copyContent(body io.ReadCloser, file *os.File, totalBytes int64,
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break // this is the regular end-of-file - we are done
 			} else {
-				return 0, err
+				return bytesRead, err
 			}
 		}
 
 		// write numBytes
 		nOut, err := bufWrite(buffer, file)
 		if err != nil {
-			log.Fatal(err)
+			return bytesRead, err
 		} else if nOut != n {
-			return 0, fmt.Errorf("% bytes read but %d byte written", n, nOut)
+			return bytesRead, fmt.Errorf("%d bytes read but %d byte written", n, nOut)
 		}
 
 		bytesRead += n
-		if !wantStdout {
-			fmt.Print(statusString(bytesRead, totalBytes, false))
+		if status != nil {
+			fmt.Fprint(status, statusString(bytesRead, totalBytes, false))
 		}
 	}
 
 	// write whatever is left
 	_, err := bufWrite(buffer[:n], file)
 	if err != nil {
-		return 0, err
+		return bytesRead, err
 	}
 
 	bytesRead += n
+
+	// a body shorter than the announced content length is truncated
+	if totalBytes != -1 && int64(bytesRead) != totalBytes {
+		return bytesRead, fmt.Errorf("received %d of %d bytes", bytesRead,
+			totalBytes)
+	}
 	return bytesRead, nil
 }
 
 // bufWrite writes content either to stdout or the requested output file
-func bufWrite(content []byte, file *os.File) (int, error) {
-	n, err := file.Write(content)
-	if err != nil {
-		return n, err
-	}
-	return n, nil
+func bufWrite(content []byte, file io.Writer) (int, error) {
+	return file.Write(content)
 }
 
 // openOutfile opens the output file if one was requested
@@ -194,20 +239,20 @@ func statusString(bytesRead int, totalBytes int64, allDone bool) string {
 }
 
 // printInfo prints a brief informative header about the connection
-func printInfo(urlTarget string, resp *http.Response) {
-	fmt.Println("********* This is gobble version ", version, " ***************")
+func printInfo(w io.Writer, urlTarget string, resp *http.Response) {
+	fmt.Fprintln(w, "********* This is gobble version ", version, " ***************")
 
 	urlInfo, err := url.Parse(urlTarget)
 	if err != nil {
 		return
 	}
-	cname, _ := net.LookupCNAME(urlInfo.Host)
+	cname, _ := net.LookupCNAME(urlInfo.Hostname())
 	ips, _ := net.LookupIP(cname)
-	fmt.Println("Connecting to", cname, "  ", ips)
-	fmt.Printf("Status %s   Protocol %s  TransferEncoding %v\n", resp.Status,
+	fmt.Fprintln(w, "Connecting to", cname, "  ", ips)
+	fmt.Fprintf(w, "Status %s   Protocol %s  TransferEncoding %v\n", resp.Status,
 		resp.Proto, resp.TransferEncoding)
-	fmt.Printf("Content Length: %d bytes\n", resp.ContentLength)
-	fmt.Println()
+	fmt.Fprintf(w, "Content Length: %d bytes\n", resp.ContentLength)
+	fmt.Fprintln(w)
 }
 
 // usage prints the package usage and then exits
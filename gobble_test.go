@@ -0,0 +1,58 @@
+// Copyright 2014 Markus Dittrich. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestScenarios runs the selftest scenarios against the test server
+func TestScenarios(t *testing.T) {
+	server := newTestServer(testPayload())
+	defer server.Close()
+
+	client := newTestClient()
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.exec(client, server.URL, t.TempDir()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestRunKeepsExistingFile checks that run refuses to overwrite an
+// existing output file and leaves its content alone
+func TestRunKeepsExistingFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new content"))
+		}))
+	defer server.Close()
+
+	fileName := filepath.Join(t.TempDir(), "output")
+	content := []byte("existing content")
+	if err := ioutil.WriteFile(fileName, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := run(&http.Client{}, server.URL, fileName, false, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected already exists error but got: %v", err)
+	}
+	got, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("existing file was modified: %q", got)
+	}
+}
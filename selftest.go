@@ -0,0 +1,236 @@
+// Copyright 2014 Markus Dittrich. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// selftest provides an embedded http server simulating common server
+// behavior (redirects, auth challenges, range support, slow and broken
+// bodies) and runs gobble's transfer code against it.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selftest settings
+var (
+	payloadSize = 3*numBytes + 123 // spans several read chunks
+	testTimeout = time.Second      // client timeout used for all scenarios
+)
+
+// scenario describes a single download of path from the test server.
+// check inspects the output file and the error returned by run.
+type scenario struct {
+	name  string
+	path  string
+	check func(fileName string, err error) error
+}
+
+// scenarios is the list of core transfer scenarios run by --selftest
+// and go test
+var scenarios = []scenario{
+	{"plain download", "/file", wantPayload},
+	{"redirect chain", "/redirect", wantPayload},
+	{"slow body", "/slow", wantPayload},
+	{"redirect loop", "/loop",
+		wantError(errorContains("stopped after 10 redirects"))},
+	{"auth challenge", "/auth",
+		wantError(errorContains("server returned 401 Unauthorized"))},
+	{"missing file", "/missing",
+		wantError(errorContains("server returned 404 Not Found"))},
+	{"unrequested partial content", "/partial",
+		wantError(errorContains("server returned 206 Partial Content"))},
+	{"stalling body", "/stall", wantError(isTimeout)},
+	{"broken content length", "/short",
+		wantError(errorContains(fmt.Sprintf("received %d of %d bytes",
+			payloadSize, payloadSize+100)))},
+}
+
+// exec downloads the scenario's path via run into a new output file
+// inside dir and checks the outcome
+func (s scenario) exec(client *http.Client, base, dir string) error {
+	fileName := filepath.Join(dir, "output")
+	return s.check(fileName, run(client, base+s.path, fileName, false,
+		ioutil.Discard))
+}
+
+// runSelfTest starts the test server, runs all scenarios against it and
+// reports the results on stdout
+func runSelfTest() error {
+	server := newTestServer(testPayload())
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gobble")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	client := newTestClient()
+	failed := 0
+	for i, s := range scenarios {
+		scenarioDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(scenarioDir, 0700); err != nil {
+			return err
+		}
+		if err := s.exec(client, server.URL, scenarioDir); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", s.name, err)
+			failed++
+		} else {
+			fmt.Printf("ok    %s\n", s.name)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d selftests failed", failed, len(scenarios))
+	}
+	return nil
+}
+
+// newTestClient returns the http client used to run scenarios. Its
+// timeout lets stalling transfers fail.
+func newTestClient() *http.Client {
+	return &http.Client{Timeout: testTimeout}
+}
+
+// testPayload returns the content served by the test server
+func testPayload() []byte {
+	payload := make([]byte, payloadSize)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	return payload
+}
+
+// newTestServer returns a running test server serving payload
+func newTestServer(payload []byte) *httptest.Server {
+	mux := http.NewServeMux()
+	modTime := time.Now()
+
+	// regular file with Range support
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", modTime, bytes.NewReader(payload))
+	})
+
+	// partial content for a plain GET as sent by a broken server or proxy
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Range", "bytes=100-199")
+		http.ServeContent(w, r, "file", modTime, bytes.NewReader(payload))
+	})
+
+	// redirect chain ending at /file
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/redirect/2", http.StatusFound)
+	})
+	mux.HandleFunc("/redirect/2", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/file", http.StatusMovedPermanently)
+	})
+
+	// redirect pointing back to itself
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+
+	// basic auth challenge
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gobble"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+
+	// body delivered in small delayed pieces
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		for i := 0; i < len(payload); i += 8192 {
+			end := i + 8192
+			if end > len(payload) {
+				end = len(payload)
+			}
+			if _, err := w.Write(payload[i:end]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	// body which stops halfway until the client gives up
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.Write(payload[:len(payload)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	// body shorter than the announced content length
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)+100))
+		w.Write(payload)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// wantPayload requires a successful download with the output file
+// containing the full test payload
+func wantPayload(fileName string, err error) error {
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, testPayload()) {
+		return fmt.Errorf("output file has %d bytes not matching expected %d "+
+			"bytes", len(content), payloadSize)
+	}
+	return nil
+}
+
+// wantError returns a check requiring the download to fail with an error
+// accepted by match and without leaving an output file behind
+func wantError(match func(error) error) func(string, error) error {
+	return func(fileName string, err error) error {
+		if err == nil {
+			return fmt.Errorf("download succeeded unexpectedly")
+		}
+		if matchErr := match(err); matchErr != nil {
+			return matchErr
+		}
+		if _, statErr := os.Stat(fileName); !os.IsNotExist(statErr) {
+			return fmt.Errorf("partial file %s was not removed", fileName)
+		}
+		return nil
+	}
+}
+
+// errorContains returns a matcher requiring the error message to
+// contain msg
+func errorContains(msg string) func(error) error {
+	return func(err error) error {
+		if !strings.Contains(err.Error(), msg) {
+			return fmt.Errorf("expected error containing %q but got: %v", msg,
+				err)
+		}
+		return nil
+	}
+}
+
+// isTimeout requires err to be a timeout
+func isTimeout(err error) error {
+	var timeoutErr interface{ Timeout() bool }
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Timeout() {
+		return fmt.Errorf("expected timeout but got: %v", err)
+	}
+	return nil
+}